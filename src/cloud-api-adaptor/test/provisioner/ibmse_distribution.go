@@ -0,0 +1,291 @@
+// (C) Copyright Confidential Containers Contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/e2e-framework/klient"
+	"sigs.k8s.io/e2e-framework/pkg/envconf"
+)
+
+// klientClient is the client handed back by envconf.Config.NewClient, named locally for
+// readability in helper signatures below.
+type klientClient = klient.Client
+
+const (
+	// IbmSeDistributionEnv selects how IBM_SE_CREDS_DIR is delivered to the worker node.
+	IbmSeDistributionEnv = "IBM_SE_DISTRIBUTION"
+	ibmSeDistributionSSH = "ssh"
+	ibmSeDistributionJob = "job"
+
+	ibmSeCredsNamespace = "coco-tenant"
+	ibmSeCredsHostPath  = "/root/ibmse"
+	ibmSeJobNamePrefix  = "ibmse-creds-distribution"
+	ibmSeSecretPrefix   = "ibmse-creds"
+
+	// ibmSeSecretChunkBytes keeps each Secret comfortably under the 1MiB etcd object limit.
+	ibmSeSecretChunkBytes = 900 * 1024
+)
+
+func getIBMSEDistributionMode() string {
+	mode := os.Getenv(IbmSeDistributionEnv)
+	if mode == "" {
+		return ibmSeDistributionSSH
+	}
+	return mode
+}
+
+// distributeIBMSECredsViaJob packages sourceDir into one or more Secrets (chunked to stay
+// under the etcd object size limit) and runs a short-lived privileged Job, pinned to
+// targetNodeName via nodeName, that unpacks them into ibmSeCredsHostPath on that node. It is the
+// Kubernetes-native alternative to copyGivenFilesToWorkerNode, which requires SSH-as-root.
+func distributeIBMSECredsViaJob(ctx context.Context, cfg *envconf.Config, sourceDir, targetNodeName string) (*ibmSEDistributionResources, error) {
+	tarFilePath, err := compressDirectory(sourceDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress directory: %v", err)
+	}
+	defer os.Remove(tarFilePath)
+
+	data, err := os.ReadFile(tarFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read compressed bundle: %v", err)
+	}
+
+	client, err := cfg.NewClient()
+	if err != nil {
+		return nil, err
+	}
+
+	// The base KBS overlay, which normally creates ibmSeCredsNamespace, is only applied after
+	// NewKeyBrokerService returns, so the namespace may not exist yet.
+	if err := ensureNamespaceExists(ctx, client, ibmSeCredsNamespace); err != nil {
+		return nil, err
+	}
+
+	secretNames, err := createIBMSECredsSecrets(ctx, client, data)
+	if err != nil {
+		return nil, err
+	}
+
+	jobName, err := createIBMSECredsDistributionJob(ctx, client, secretNames, targetNodeName)
+	if err != nil {
+		return &ibmSEDistributionResources{secretNames: secretNames}, err
+	}
+
+	if err := waitForJobComplete(ctx, client, jobName, 5*time.Minute); err != nil {
+		return &ibmSEDistributionResources{secretNames: secretNames, jobName: jobName}, err
+	}
+
+	return &ibmSEDistributionResources{secretNames: secretNames, jobName: jobName}, nil
+}
+
+// ibmSEDistributionResources tracks the Secret(s) and Job created by distributeIBMSECredsViaJob so
+// KeyBrokerService.Delete can clean them up.
+type ibmSEDistributionResources struct {
+	secretNames []string
+	jobName     string
+}
+
+// ensureNamespaceExists creates namespace if it does not already exist. Callers that need to
+// create resources in a namespace normally managed by a kustomize overlay (e.g. coco-tenant) may
+// run before that overlay has been applied.
+func ensureNamespaceExists(ctx context.Context, client klientClient, namespace string) error {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}}
+	if err := client.Resources().Create(ctx, ns); err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("creating namespace %s: %w", namespace, err)
+	}
+	return nil
+}
+
+// createOrUpdateSecret creates secret, or overwrites its Data/Type in place if a Secret with the
+// same name/namespace already exists -- e.g. because a prior Deploy, or an auth-key rotation that
+// re-runs deployKbsTLSSecret/createHAAuthSecret, already created it.
+func createOrUpdateSecret(ctx context.Context, client klientClient, secret *corev1.Secret) error {
+	if err := client.Resources().Create(ctx, secret); err != nil {
+		if !apierrors.IsAlreadyExists(err) {
+			return err
+		}
+		existing := &corev1.Secret{}
+		if err := client.Resources().Get(ctx, secret.Name, secret.Namespace, existing); err != nil {
+			return err
+		}
+		existing.Type = secret.Type
+		existing.Data = secret.Data
+		return client.Resources().Update(ctx, existing)
+	}
+	return nil
+}
+
+func createIBMSECredsSecrets(ctx context.Context, client klientClient, data []byte) ([]string, error) {
+	var names []string
+	for i := 0; i*ibmSeSecretChunkBytes < len(data); i++ {
+		start := i * ibmSeSecretChunkBytes
+		end := start + ibmSeSecretChunkBytes
+		if end > len(data) {
+			end = len(data)
+		}
+
+		name := fmt.Sprintf("%s-%02d", ibmSeSecretPrefix, i)
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: ibmSeCredsNamespace,
+			},
+			Type: corev1.SecretTypeOpaque,
+			Data: map[string][]byte{
+				"chunk.tar.gz": data[start:end],
+			},
+		}
+
+		log.Infof("creating IBM SE creds secret %s (%d bytes)", name, end-start)
+		if err := client.Resources().Create(ctx, secret); err != nil {
+			return names, fmt.Errorf("creating secret %s: %w", name, err)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func createIBMSECredsDistributionJob(ctx context.Context, client klientClient, secretNames []string, targetNodeName string) (string, error) {
+	jobName := ibmSeJobNamePrefix
+	privileged := true
+	hostPathDirectoryOrCreate := corev1.HostPathDirectoryOrCreate
+
+	var volumes []corev1.Volume
+	var mounts []corev1.VolumeMount
+	var reassembleCmd string
+	for i, name := range secretNames {
+		volumeName := fmt.Sprintf("secret-%d", i)
+		volumes = append(volumes, corev1.Volume{
+			Name: volumeName,
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{SecretName: name},
+			},
+		})
+		mounts = append(mounts, corev1.VolumeMount{
+			Name:      volumeName,
+			MountPath: fmt.Sprintf("/secrets/%02d", i),
+			ReadOnly:  true,
+		})
+		reassembleCmd += fmt.Sprintf("cat /secrets/%02d/chunk.tar.gz >> /tmp/bundle.tar.gz && ", i)
+	}
+	// Mount the hostPath *parent* (ibmSeCredsHostPath's dir, e.g. /root), not ibmSeCredsHostPath
+	// itself: the bundle's top-level entry is already the "ibmse" directory (see
+	// compressDirectory), so extracting into the parent reproduces the layout
+	// copyGivenFilesToWorkerNode produces by untarring into /root over SSH.
+	hostMountPath := filepath.Dir(ibmSeCredsHostPath)
+	volumes = append(volumes, corev1.Volume{
+		Name: "ibmse-hostpath",
+		VolumeSource: corev1.VolumeSource{
+			HostPath: &corev1.HostPathVolumeSource{
+				Path: hostMountPath,
+				Type: &hostPathDirectoryOrCreate,
+			},
+		},
+	})
+	mounts = append(mounts, corev1.VolumeMount{
+		Name:      "ibmse-hostpath",
+		MountPath: "/host/target",
+	})
+
+	cmd := reassembleCmd + "tar -xzf /tmp/bundle.tar.gz -C /host/target"
+
+	backoffLimit := int32(1)
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      jobName,
+			Namespace: ibmSeCredsNamespace,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{"app": jobName},
+				},
+				Spec: corev1.PodSpec{
+					NodeName:      targetNodeName,
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{
+						{
+							Name:    "distribute-ibmse-creds",
+							Image:   "busybox",
+							Command: []string{"sh", "-c", cmd},
+							SecurityContext: &corev1.SecurityContext{
+								Privileged: &privileged,
+							},
+							VolumeMounts: mounts,
+						},
+					},
+					Volumes: volumes,
+				},
+			},
+		},
+	}
+
+	log.Infof("creating IBM SE creds distribution job %s on node %s", jobName, targetNodeName)
+	if err := client.Resources().Create(ctx, job); err != nil {
+		return "", fmt.Errorf("creating job %s: %w", jobName, err)
+	}
+	return jobName, nil
+}
+
+func waitForJobComplete(ctx context.Context, client klientClient, jobName string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		job := &batchv1.Job{}
+		if err := client.Resources(ibmSeCredsNamespace).Get(ctx, jobName, ibmSeCredsNamespace, job); err != nil {
+			return fmt.Errorf("getting job %s: %w", jobName, err)
+		}
+		for _, cond := range job.Status.Conditions {
+			if cond.Type == batchv1.JobComplete && cond.Status == corev1.ConditionTrue {
+				return nil
+			}
+			if cond.Type == batchv1.JobFailed && cond.Status == corev1.ConditionTrue {
+				return fmt.Errorf("job %s failed: %s", jobName, cond.Message)
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for job %s to complete", jobName)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func deleteIBMSEDistributionResources(ctx context.Context, cfg *envconf.Config, res *ibmSEDistributionResources) error {
+	if res == nil {
+		return nil
+	}
+
+	client, err := cfg.NewClient()
+	if err != nil {
+		return err
+	}
+
+	if res.jobName != "" {
+		job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: res.jobName, Namespace: ibmSeCredsNamespace}}
+		propagation := metav1.DeletePropagationBackground
+		if err := client.Resources().Delete(ctx, job, func(opts *metav1.DeleteOptions) { opts.PropagationPolicy = &propagation }); err != nil {
+			log.Warnf("failed to delete job %s: %v", res.jobName, err)
+		}
+	}
+
+	for _, name := range res.secretNames {
+		secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ibmSeCredsNamespace}}
+		if err := client.Resources().Delete(ctx, secret); err != nil {
+			log.Warnf("failed to delete secret %s: %v", name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,340 @@
+// (C) Copyright Confidential Containers Contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package provisioner
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/e2e-framework/pkg/envconf"
+)
+
+const airgapImageImporterName = "kbs-airgap-image-importer"
+
+// AirgapKbsInstallOverlay wraps the plain KBS overlay with an airgap workflow: it loads a
+// pre-built image tarball into every node's container runtime and rewrites the overlay's image
+// references to the given registry mirror, so tests can run without pulling from ghcr.io/quay.io.
+type AirgapKbsInstallOverlay struct {
+	overlay        InstallOverlay
+	registryMirror string
+	imageTarball   string
+}
+
+// NewAirgapKbsInstallOverlay builds the KBS overlay used in disconnected CoCo environments.
+// If imageTarball is set, it is imported into the cluster's container runtime via a DaemonSet
+// running `ctr -n k8s.io images import` on each node. If registryMirror is set as well, every image
+// tag found in the tarball manifest is additionally re-tagged as ${registryMirror}/${originalRepo}:${tag}
+// and a kustomize image transformer rewrites the overlay's KBS/trustee image references to match.
+// A registryMirror given without an imageTarball neither re-tags nor rewrites anything.
+func NewAirgapKbsInstallOverlay(installDir, registryMirror, imageTarball string) (InstallOverlay, error) {
+	log.Info("Creating airgap kbs install overlay")
+
+	if registryMirror != "" && imageTarball != "" {
+		repoTags, err := readImageTarballRepoTags(imageTarball)
+		if err != nil {
+			return nil, err
+		}
+
+		overlayFolder, err := getKbsOverlayFolder()
+		if err != nil {
+			return nil, err
+		}
+		if err := writeAirgapImageTransformer(filepath.Join(installDir, overlayFolder), registryMirror, repoTags); err != nil {
+			return nil, err
+		}
+	}
+
+	overlay, err := NewKbsInstallOverlay(installDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AirgapKbsInstallOverlay{
+		overlay:        overlay,
+		registryMirror: registryMirror,
+		imageTarball:   imageTarball,
+	}, nil
+}
+
+func (a *AirgapKbsInstallOverlay) Apply(ctx context.Context, cfg *envconf.Config) error {
+	if a.imageTarball != "" {
+		log.Infof("Importing airgap image tarball %s into the cluster container runtime", a.imageTarball)
+		if err := importAirgapImageTarball(ctx, cfg, a.imageTarball, a.registryMirror); err != nil {
+			return err
+		}
+	}
+	return a.overlay.Apply(ctx, cfg)
+}
+
+func (a *AirgapKbsInstallOverlay) Delete(ctx context.Context, cfg *envconf.Config) error {
+	if err := a.overlay.Delete(ctx, cfg); err != nil {
+		return err
+	}
+	if a.imageTarball != "" {
+		return deleteAirgapImageImporter(ctx, cfg)
+	}
+	return nil
+}
+
+func (a *AirgapKbsInstallOverlay) Edit(ctx context.Context, cfg *envconf.Config, props map[string]string) error {
+	return a.overlay.Edit(ctx, cfg, props)
+}
+
+// dockerSaveManifestEntry mirrors the shape of the manifest.json produced by `docker save` /
+// `ctr images export`.
+type dockerSaveManifestEntry struct {
+	RepoTags []string `json:"RepoTags"`
+}
+
+// readImageTarballRepoTags walks the tarball's manifest.json and returns every "repo:tag"
+// reference it contains.
+func readImageTarballRepoTags(imageTarball string) ([]string, error) {
+	f, err := os.Open(imageTarball)
+	if err != nil {
+		return nil, fmt.Errorf("opening image tarball %s: %w", imageTarball, err)
+	}
+	defer f.Close()
+
+	var reader io.Reader = f
+	if strings.HasSuffix(imageTarball, ".gz") || strings.HasSuffix(imageTarball, ".tgz") {
+		gzReader, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("reading gzip image tarball %s: %w", imageTarball, err)
+		}
+		defer gzReader.Close()
+		reader = gzReader
+	}
+
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading image tarball %s: %w", imageTarball, err)
+		}
+		if hdr.Name != "manifest.json" {
+			continue
+		}
+
+		var entries []dockerSaveManifestEntry
+		if err := json.NewDecoder(tr).Decode(&entries); err != nil {
+			return nil, fmt.Errorf("decoding manifest.json in %s: %w", imageTarball, err)
+		}
+
+		var repoTags []string
+		for _, entry := range entries {
+			repoTags = append(repoTags, entry.RepoTags...)
+		}
+		return repoTags, nil
+	}
+
+	return nil, fmt.Errorf("manifest.json not found in image tarball %s", imageTarball)
+}
+
+// airgapImagesBeginMarker/airgapImagesEndMarker delimit the block writeAirgapImageTransformer
+// writes into kustomization.yaml, so the block can be replaced rather than appended again.
+const (
+	airgapImagesBeginMarker = "# --- begin airgap image transformer (generated) ---"
+	airgapImagesEndMarker   = "# --- end airgap image transformer (generated) ---"
+)
+
+// writeAirgapImageTransformer (re)writes a kustomize images transformer in kustomization.yaml in
+// overlayDir, rewriting each repoTag found in the tarball to ${registryMirror}/${strippedRepo}:${tag},
+// where strippedRepo drops the leading registry-host segment of the original repo. This must
+// match what importAirgapImageTarball's `ctr images tag` actually tags the image as in containerd
+// (it strips that same leading segment via sed), or pods pull a tag that was never created.
+// NewAirgapKbsInstallOverlay is constructed on both Deploy and Delete, so this must be idempotent:
+// a prior block, if any, is stripped before the current one is written.
+func writeAirgapImageTransformer(overlayDir, registryMirror string, repoTags []string) error {
+	kustomizationPath := filepath.Join(overlayDir, "kustomization.yaml")
+	data, err := os.ReadFile(kustomizationPath)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", kustomizationPath, err)
+	}
+
+	var sb strings.Builder
+	sb.WriteString("\n" + airgapImagesBeginMarker + "\n")
+	sb.WriteString("images:\n")
+	for _, repoTag := range repoTags {
+		repo, tag := splitRepoTag(repoTag)
+		sb.WriteString(fmt.Sprintf("  - name: %s\n", repo))
+		sb.WriteString(fmt.Sprintf("    newName: %s/%s\n", registryMirror, stripLeadingRegistryHost(repo)))
+		sb.WriteString(fmt.Sprintf("    newTag: %q\n", tag))
+	}
+	sb.WriteString(airgapImagesEndMarker + "\n")
+
+	content := stripAirgapImageTransformer(string(data)) + sb.String()
+	if err := os.WriteFile(kustomizationPath, []byte(content), 0644); err != nil {
+		return fmt.Errorf("writing %s: %w", kustomizationPath, err)
+	}
+	return nil
+}
+
+// stripAirgapImageTransformer removes a previously-written
+// airgapImagesBeginMarker/airgapImagesEndMarker block, along with the blank line(s) surrounding
+// it, from content. It is a no-op if no such block is present.
+func stripAirgapImageTransformer(content string) string {
+	begin := strings.Index(content, airgapImagesBeginMarker)
+	if begin < 0 {
+		return content
+	}
+	end := strings.Index(content, airgapImagesEndMarker)
+	if end < 0 {
+		return content
+	}
+	end += len(airgapImagesEndMarker)
+
+	for begin > 0 && content[begin-1] == '\n' {
+		begin--
+	}
+	for end < len(content) && content[end] == '\n' {
+		end++
+	}
+	return content[:begin] + content[end:]
+}
+
+func splitRepoTag(repoTag string) (repo, tag string) {
+	idx := strings.LastIndex(repoTag, ":")
+	if idx < 0 {
+		return repoTag, "latest"
+	}
+	return repoTag[:idx], repoTag[idx+1:]
+}
+
+// stripLeadingRegistryHost drops the leading "host/" segment from repo, mirroring the
+// `sed -E 's#^[^/]+/##'` importAirgapImageTarball applies to each ref before re-tagging it under
+// registryMirror, so the kustomize newName generated here matches what ctr actually tagged.
+// ctr lists Docker Hub names without a registry host under docker.io (and single-segment names
+// under docker.io/library), so "busybox" maps to "library/busybox" and "org/repo" stays as is.
+func stripLeadingRegistryHost(repo string) string {
+	host, rest, found := strings.Cut(repo, "/")
+	if !found || (!strings.ContainsAny(host, ".:") && host != "localhost") {
+		rest = repo
+	}
+	if (!found || host == "docker.io") && !strings.Contains(rest, "/") {
+		rest = "library/" + rest
+	}
+	return rest
+}
+
+// importAirgapImageTarball runs a DaemonSet that imports imageTarball into every node's
+// containerd via `ctr -n k8s.io images import`, additionally tagging each image under
+// registryMirror when set, so pods referencing the mirror resolve locally. imageTarball must
+// already be reachable at the same host path on every node (e.g. a shared/pre-staged directory).
+func importAirgapImageTarball(ctx context.Context, cfg *envconf.Config, imageTarball, registryMirror string) error {
+	client, err := cfg.NewClient()
+	if err != nil {
+		return err
+	}
+
+	// Apply runs before a.overlay.Apply, which is what normally creates ibmSeCredsNamespace.
+	if err := ensureNamespaceExists(ctx, client, ibmSeCredsNamespace); err != nil {
+		return err
+	}
+
+	privileged := true
+	hostPathFile := corev1.HostPathFile
+	tagCmd := ""
+	if registryMirror != "" {
+		tagCmd = fmt.Sprintf(
+			`for ref in $(ctr -n k8s.io images list -q); do ctr -n k8s.io images tag "$ref" "%s/$(echo "$ref" | sed -E 's#^[^/]+/##')" || true; done && `,
+			registryMirror,
+		)
+	}
+	cmd := fmt.Sprintf("ctr -n k8s.io images import /images/airgap.tar && %ssleep infinity", tagCmd)
+
+	daemonSet := &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      airgapImageImporterName,
+			Namespace: ibmSeCredsNamespace,
+		},
+		Spec: appsv1.DaemonSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": airgapImageImporterName}},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": airgapImageImporterName}},
+				Spec: corev1.PodSpec{
+					HostPID: true,
+					Containers: []corev1.Container{
+						{
+							Name:    "import",
+							Image:   "busybox",
+							Command: []string{"sh", "-c", cmd},
+							SecurityContext: &corev1.SecurityContext{
+								Privileged: &privileged,
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{Name: "containerd-sock", MountPath: "/run/containerd/containerd.sock"},
+								{Name: "image-tarball", MountPath: "/images/airgap.tar"},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: "containerd-sock",
+							VolumeSource: corev1.VolumeSource{
+								HostPath: &corev1.HostPathVolumeSource{Path: "/run/containerd/containerd.sock", Type: &hostPathFile},
+							},
+						},
+						{
+							Name: "image-tarball",
+							VolumeSource: corev1.VolumeSource{
+								HostPath: &corev1.HostPathVolumeSource{Path: imageTarball, Type: &hostPathFile},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	log.Info("creating airgap image importer DaemonSet")
+	if err := client.Resources().Create(ctx, daemonSet); err != nil {
+		return fmt.Errorf("creating daemonset %s: %w", airgapImageImporterName, err)
+	}
+
+	return waitForDaemonSetReady(ctx, client, airgapImageImporterName, 5*time.Minute)
+}
+
+func waitForDaemonSetReady(ctx context.Context, client klientClient, name string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		ds := &appsv1.DaemonSet{}
+		if err := client.Resources(ibmSeCredsNamespace).Get(ctx, name, ibmSeCredsNamespace, ds); err != nil {
+			return fmt.Errorf("getting daemonset %s: %w", name, err)
+		}
+		if ds.Status.DesiredNumberScheduled > 0 && ds.Status.NumberReady == ds.Status.DesiredNumberScheduled {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for daemonset %s to become ready", name)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func deleteAirgapImageImporter(ctx context.Context, cfg *envconf.Config) error {
+	client, err := cfg.NewClient()
+	if err != nil {
+		return err
+	}
+	ds := &appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Name: airgapImageImporterName, Namespace: ibmSeCredsNamespace}}
+	if err := client.Resources().Delete(ctx, ds); err != nil {
+		log.Warnf("failed to delete daemonset %s: %v", airgapImageImporterName, err)
+	}
+	return nil
+}
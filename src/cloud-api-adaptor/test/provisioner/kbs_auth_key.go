@@ -0,0 +1,180 @@
+// (C) Copyright Confidential Containers Contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package provisioner
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// KbsAuthKeyAlgorithm selects the keypair algorithm used to sign requests to the KBS, matching
+// what Trustee's kbs-client accepts.
+type KbsAuthKeyAlgorithm string
+
+const (
+	KbsAuthKeyAlgorithmEd25519   KbsAuthKeyAlgorithm = "ed25519"
+	KbsAuthKeyAlgorithmRSA2048   KbsAuthKeyAlgorithm = "rsa2048"
+	KbsAuthKeyAlgorithmRSA4096   KbsAuthKeyAlgorithm = "rsa4096"
+	KbsAuthKeyAlgorithmECDSAP256 KbsAuthKeyAlgorithm = "ecdsa-p256"
+	KbsAuthKeyAlgorithmECDSAP384 KbsAuthKeyAlgorithm = "ecdsa-p384"
+)
+
+// KbsAuthKeyConfig configures the KBS auth keypair. If ExistingPrivateKeyPath is set, that
+// externally managed key is imported instead of generating a new one, and Algorithm is used only
+// to label the persisted metadata.
+type KbsAuthKeyConfig struct {
+	Algorithm              KbsAuthKeyAlgorithm
+	ExistingPrivateKeyPath string
+}
+
+type kbsAuthKeyMetadata struct {
+	Algorithm   KbsAuthKeyAlgorithm `json:"algorithm"`
+	Fingerprint string              `json:"fingerprint"`
+	CreatedAt   string              `json:"createdAt"`
+}
+
+func kbsAuthKeyMetadataPath() string {
+	return filepath.Join(getKbsKubernetesFilePath(), "base/kbs-auth-key-metadata.json")
+}
+
+// prepareKbsAuthKeyPair generates or imports the KBS auth keypair described by authKeyCfg,
+// returning the PEM-encoded private/public keys and the algorithm label to persist alongside them.
+func prepareKbsAuthKeyPair(authKeyCfg KbsAuthKeyConfig) (privPEM, pubPEM []byte, algorithm KbsAuthKeyAlgorithm, err error) {
+	if authKeyCfg.ExistingPrivateKeyPath != "" {
+		privPEM, pubPEM, err = importKbsAuthKeyPair(authKeyCfg.ExistingPrivateKeyPath)
+		algorithm = authKeyCfg.Algorithm
+		if algorithm == "" {
+			algorithm = "imported"
+		}
+		return
+	}
+
+	algorithm = authKeyCfg.Algorithm
+	if algorithm == "" {
+		algorithm = KbsAuthKeyAlgorithmEd25519
+	}
+	privPEM, pubPEM, err = generateKbsAuthKeyPair(algorithm)
+	return
+}
+
+func generateKbsAuthKeyPair(algorithm KbsAuthKeyAlgorithm) ([]byte, []byte, error) {
+	var pub, priv any
+	var err error
+
+	switch algorithm {
+	case KbsAuthKeyAlgorithmEd25519:
+		pub, priv, err = ed25519.GenerateKey(rand.Reader)
+	case KbsAuthKeyAlgorithmRSA2048:
+		priv, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err == nil {
+			pub = &priv.(*rsa.PrivateKey).PublicKey
+		}
+	case KbsAuthKeyAlgorithmRSA4096:
+		priv, err = rsa.GenerateKey(rand.Reader, 4096)
+		if err == nil {
+			pub = &priv.(*rsa.PrivateKey).PublicKey
+		}
+	case KbsAuthKeyAlgorithmECDSAP256:
+		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err == nil {
+			pub = &priv.(*ecdsa.PrivateKey).PublicKey
+		}
+	case KbsAuthKeyAlgorithmECDSAP384:
+		priv, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		if err == nil {
+			pub = &priv.(*ecdsa.PrivateKey).PublicKey
+		}
+	default:
+		return nil, nil, fmt.Errorf("unsupported KBS auth key algorithm: %s", algorithm)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("generating %s key pair: %w", algorithm, err)
+	}
+
+	return marshalKbsAuthKeyPair(pub, priv)
+}
+
+func importKbsAuthKeyPair(path string) ([]byte, []byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading existing private key %s: %w", path, err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, nil, fmt.Errorf("no PEM block found in %s", path)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing private key %s: %w", path, err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported private key type in %s", path)
+	}
+
+	return marshalKbsAuthKeyPair(signer.Public(), key)
+}
+
+func marshalKbsAuthKeyPair(pub, priv any) ([]byte, []byte, error) {
+	privBytes, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, nil, fmt.Errorf("MarshalPKCS8PrivateKey private key: %w", err)
+	}
+	privPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privBytes})
+
+	pubBytes, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, nil, fmt.Errorf("MarshalPKIXPublicKey public key: %w", err)
+	}
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes})
+
+	return privPEM, pubPEM, nil
+}
+
+func kbsAuthKeyFingerprint(pubPEM []byte) (string, error) {
+	block, _ := pem.Decode(pubPEM)
+	if block == nil {
+		return "", fmt.Errorf("decoding public key PEM")
+	}
+	sum := sha256.Sum256(block.Bytes)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// writeKbsAuthKeyMetadata persists the algorithm, public key fingerprint and creation timestamp
+// next to base/kbs.key and base/kbs.pem, so tests can assert against it across rotations.
+func writeKbsAuthKeyMetadata(path string, algorithm KbsAuthKeyAlgorithm, pubPEM []byte) error {
+	fingerprint, err := kbsAuthKeyFingerprint(pubPEM)
+	if err != nil {
+		return err
+	}
+
+	meta := kbsAuthKeyMetadata{
+		Algorithm:   algorithm,
+		Fingerprint: fingerprint,
+		CreatedAt:   time.Now().UTC().Format(time.RFC3339),
+	}
+
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling kbs auth key metadata: %w", err)
+	}
+
+	return saveToFile(path, data)
+}
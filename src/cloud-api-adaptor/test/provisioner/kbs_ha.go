@@ -0,0 +1,429 @@
+// (C) Copyright Confidential Containers Contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package provisioner
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/e2e-framework/klient/k8s"
+	"sigs.k8s.io/e2e-framework/pkg/envconf"
+)
+
+const kbsHALabelSelector = "app=kbs"
+
+// KbsHAConfig enables a multi-replica KBS deployment fronted by a stable virtual endpoint,
+// mirroring the embedded-cluster/multi-node HA scenarios used elsewhere in the project.
+type KbsHAConfig struct {
+	// Replicas is the desired KBS replica count. Defaults to 2 when unset.
+	Replicas int32
+
+	// VIP is the stable address clients use to reach KBS regardless of which replica answers:
+	// either a MetalLB-assigned LoadBalancer IP, or a fixed address to request via
+	// spec.loadBalancerIP/the metallb.universe.tf/loadBalancerIPs annotation.
+	VIP string
+
+	// UseLoadBalancerService switches the kbs Service to type LoadBalancer. When false and VIP is
+	// set, the Service is annotated with VIP for MetalLB and also switched to type LoadBalancer;
+	// when false and VIP is empty, the Service is left unchanged.
+	UseLoadBalancerService bool
+}
+
+// WithHAConfig enables HA mode (multiple KBS replicas behind haConfig.VIP) for the overlay
+// created by Deploy/Delete.
+func WithHAConfig(haConfig KbsHAConfig) KbsServiceOption {
+	return func(o *kbsServiceOptions) {
+		o.haConfig = &haConfig
+	}
+}
+
+// HAKbsInstallOverlay wraps another KBS overlay and, on Apply, scales the deployment to
+// haConfig.Replicas, spreads replicas across nodes, switches shared auth material from a
+// hostPath volume to a projected Secret (so no shared filesystem is required), and points the
+// Service at haConfig.VIP.
+type HAKbsInstallOverlay struct {
+	overlay  InstallOverlay
+	haConfig KbsHAConfig
+}
+
+// NewHAKbsInstallOverlay builds a standalone HA KBS overlay (the plain nodeport/custom pccs
+// overlay under the hood). newKbsDeployOverlay composes this with the airgap overlay instead
+// when both are requested.
+func NewHAKbsInstallOverlay(installDir string, haConfig KbsHAConfig) (InstallOverlay, error) {
+	overlay, err := NewKbsInstallOverlay(installDir)
+	if err != nil {
+		return nil, err
+	}
+	return &HAKbsInstallOverlay{overlay: overlay, haConfig: haConfig}, nil
+}
+
+func (h *HAKbsInstallOverlay) Apply(ctx context.Context, cfg *envconf.Config) error {
+	if err := h.overlay.Apply(ctx, cfg); err != nil {
+		return err
+	}
+	return scaleKbsForHA(ctx, cfg, h.haConfig)
+}
+
+func (h *HAKbsInstallOverlay) Delete(ctx context.Context, cfg *envconf.Config) error {
+	return h.overlay.Delete(ctx, cfg)
+}
+
+func (h *HAKbsInstallOverlay) Edit(ctx context.Context, cfg *envconf.Config, props map[string]string) error {
+	return h.overlay.Edit(ctx, cfg, props)
+}
+
+func kbsHAReplicas(haConfig KbsHAConfig) int32 {
+	if haConfig.Replicas < 1 {
+		return 2
+	}
+	return haConfig.Replicas
+}
+
+func scaleKbsForHA(ctx context.Context, cfg *envconf.Config, haConfig KbsHAConfig) error {
+	client, err := cfg.NewClient()
+	if err != nil {
+		return err
+	}
+
+	namespace := "coco-tenant"
+	deploymentName := "kbs"
+	resources := client.Resources(namespace)
+
+	deployment := &appsv1.Deployment{}
+	if err := resources.Get(ctx, deploymentName, namespace, deployment); err != nil {
+		return err
+	}
+
+	replicas := kbsHAReplicas(haConfig)
+	deployment.Spec.Replicas = &replicas
+
+	// Shared auth material (e.g. the IBM SE hostPath PV) can't be mounted from several nodes at
+	// once; replace any hostPath volume with a projected Secret instead, so replicas don't need
+	// a shared filesystem.
+	for i := range deployment.Spec.Template.Spec.Volumes {
+		v := &deployment.Spec.Template.Spec.Volumes[i]
+		if v.HostPath == nil {
+			continue
+		}
+
+		sourceDir, err := haAuthSourceDirFor(v.HostPath.Path)
+		if err != nil {
+			return fmt.Errorf("replacing hostPath volume %s for HA: %w", v.Name, err)
+		}
+
+		secretName := fmt.Sprintf("%s-auth", v.Name)
+		log.Infof("HA mode: replacing hostPath volume %s with a shared Secret volume", v.Name)
+		if err := createHAAuthSecret(ctx, client, sourceDir, secretName); err != nil {
+			return err
+		}
+		v.HostPath = nil
+		v.Secret = &corev1.SecretVolumeSource{SecretName: secretName}
+	}
+
+	// Spread replicas across nodes so a single node failure doesn't take every replica down.
+	deployment.Spec.Template.Spec.Affinity = &corev1.Affinity{
+		PodAntiAffinity: &corev1.PodAntiAffinity{
+			PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{
+				{
+					Weight: 100,
+					PodAffinityTerm: corev1.PodAffinityTerm{
+						LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "kbs"}},
+						TopologyKey:   "kubernetes.io/hostname",
+					},
+				},
+			},
+		},
+	}
+
+	if err := resources.Update(ctx, deployment); err != nil {
+		return fmt.Errorf("scaling kbs deployment for HA: %w", err)
+	}
+
+	return patchKbsServiceForHA(ctx, resources, haConfig)
+}
+
+// haAuthSourceDirFor maps a hostPath volume's node-local path back to the local directory its
+// contents were originally distributed from, so createHAAuthSecret can repackage the same data
+// into a Secret. ibmSeCredsHostPath is currently the only hostPath volume KBS ever mounts.
+func haAuthSourceDirFor(hostPath string) (string, error) {
+	if hostPath != ibmSeCredsHostPath {
+		return "", fmt.Errorf("no known local source directory for hostPath %s", hostPath)
+	}
+	sourceDir := os.Getenv("IBM_SE_CREDS_DIR")
+	if sourceDir == "" {
+		return "", fmt.Errorf("IBM_SE_CREDS_DIR not set, cannot repackage %s into a Secret", hostPath)
+	}
+	return sourceDir, nil
+}
+
+// createHAAuthSecret packages every regular file directly under sourceDir into a same-named key
+// of Secret secretName, so HA replicas can mount shared auth material (e.g. IBM SE creds) without
+// a shared filesystem.
+func createHAAuthSecret(ctx context.Context, client klientClient, sourceDir, secretName string) error {
+	entries, err := os.ReadDir(sourceDir)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", sourceDir, err)
+	}
+
+	data := map[string][]byte{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(sourceDir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", entry.Name(), err)
+		}
+		data[entry.Name()] = content
+	}
+
+	if err := ensureNamespaceExists(ctx, client, ibmSeCredsNamespace); err != nil {
+		return err
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: secretName, Namespace: ibmSeCredsNamespace},
+		Type:       corev1.SecretTypeOpaque,
+		Data:       data,
+	}
+
+	log.Infof("creating HA auth secret %s from %s", secretName, sourceDir)
+	if err := createOrUpdateSecret(ctx, client, secret); err != nil {
+		return fmt.Errorf("creating secret %s: %w", secretName, err)
+	}
+	return nil
+}
+
+func patchKbsServiceForHA(ctx context.Context, resources k8s.Resources, haConfig KbsHAConfig) error {
+	service := &corev1.Service{}
+	if err := resources.Get(ctx, "kbs", "coco-tenant", service); err != nil {
+		return err
+	}
+
+	if haConfig.UseLoadBalancerService {
+		service.Spec.Type = corev1.ServiceTypeLoadBalancer
+		if haConfig.VIP != "" {
+			service.Spec.LoadBalancerIP = haConfig.VIP
+		}
+	} else if haConfig.VIP != "" {
+		if service.ObjectMeta.Annotations == nil {
+			service.ObjectMeta.Annotations = map[string]string{}
+		}
+		service.ObjectMeta.Annotations["metallb.universe.tf/loadBalancerIPs"] = haConfig.VIP
+		service.Spec.Type = corev1.ServiceTypeLoadBalancer
+	}
+
+	return resources.Update(ctx, service)
+}
+
+// waitForHAReplicasReady polls until haConfig.Replicas KBS pods are Ready and each answers
+// /kbs/v0/version over a port-forward, then returns the stable VIP endpoint clients should use.
+func waitForHAReplicasReady(ctx context.Context, cfg *envconf.Config, namespace string, haConfig KbsHAConfig, tlsEnabled bool) (string, error) {
+	client, err := cfg.NewClient()
+	if err != nil {
+		return "", err
+	}
+	resources := client.Resources(namespace)
+
+	wantReplicas := kbsHAReplicas(haConfig)
+	budget := getKbsEndpointTimeout()
+	deadline := time.Now().Add(budget)
+
+	for attempt := 0; ; attempt++ {
+		pods := &corev1.PodList{}
+		if err := resources.WithLabelSelector(kbsHALabelSelector).List(ctx, pods); err != nil {
+			return "", err
+		}
+
+		readyNames := readyKbsPodNames(pods)
+		allHealthy := int32(len(readyNames)) >= wantReplicas
+		for _, name := range readyNames {
+			if !allHealthy {
+				break
+			}
+			if err := probeKbsReplicaVersion(cfg, name, namespace, tlsEnabled); err != nil {
+				log.Warnf("KBS replica %s failed /kbs/v0/version probe: %v", name, err)
+				allHealthy = false
+			}
+		}
+
+		if allHealthy {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("timed out after %s waiting for %d/%d KBS HA replicas to become healthy", budget, len(readyNames), wantReplicas)
+		}
+
+		backoff := kbsEndpointBackoffBase << attempt
+		if backoff <= 0 || backoff > kbsEndpointBackoffCap {
+			backoff = kbsEndpointBackoffCap
+		}
+		log.Infof("%d/%d KBS HA replicas healthy, retrying in %s", len(readyNames), wantReplicas, backoff)
+		time.Sleep(backoff)
+	}
+
+	services := &corev1.ServiceList{}
+	if err := resources.List(ctx, services); err != nil {
+		return "", err
+	}
+	var port int32
+	for _, svc := range services.Items {
+		if svc.ObjectMeta.Name == "kbs" && len(svc.Spec.Ports) > 0 {
+			port = svc.Spec.Ports[0].Port
+			break
+		}
+	}
+	if port == 0 {
+		return "", fmt.Errorf("kbs service port not found")
+	}
+
+	vip := haConfig.VIP
+	if vip == "" {
+		if !haConfig.UseLoadBalancerService {
+			return "", fmt.Errorf("KBS HA endpoint requires haConfig.VIP (or UseLoadBalancerService to assign one), neither was configured")
+		}
+		assignedVIP, err := waitForKbsServiceLoadBalancerIP(ctx, resources, time.Until(deadline))
+		if err != nil {
+			return "", err
+		}
+		vip = assignedVIP
+	}
+
+	scheme := "http"
+	if tlsEnabled {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s:%d", scheme, vip, port), nil
+}
+
+// waitForKbsServiceLoadBalancerIP polls the kbs Service until the load balancer has assigned an
+// external IP, for the UseLoadBalancerService case where no fixed VIP was requested up front.
+func waitForKbsServiceLoadBalancerIP(ctx context.Context, resources k8s.Resources, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		service := &corev1.Service{}
+		if err := resources.Get(ctx, "kbs", "coco-tenant", service); err != nil {
+			return "", err
+		}
+		for _, ingress := range service.Status.LoadBalancer.Ingress {
+			if ingress.IP != "" {
+				return ingress.IP, nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("timed out waiting for kbs Service to be assigned a LoadBalancer IP")
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func readyKbsPodNames(pods *corev1.PodList) []string {
+	var names []string
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		for _, c := range pod.Status.Conditions {
+			if c.Type == corev1.PodReady && c.Status == corev1.ConditionTrue {
+				names = append(names, pod.Name)
+				break
+			}
+		}
+	}
+	return names
+}
+
+// probeKbsReplicaVersion port-forwards to podName and checks that it answers /kbs/v0/version.
+// tlsEnabled must match the scheme KBS is actually serving: patchKbsConfigForTLS makes it serve
+// HTTPS on the same port once a TLSConfig is set.
+func probeKbsReplicaVersion(cfg *envconf.Config, podName, namespace string, tlsEnabled bool) error {
+	localPort, err := getFreeLocalPort()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("kubectl", "port-forward", fmt.Sprintf("pod/%s", podName), fmt.Sprintf("%d:8080", localPort), "-n", namespace)
+	cmd.Env = append(os.Environ(), "KUBECONFIG="+cfg.KubeconfigFile())
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("starting port-forward to %s: %w", podName, err)
+	}
+	defer cmd.Process.Kill()
+
+	// Give the port-forward a moment to establish before probing.
+	time.Sleep(time.Second)
+
+	scheme := "http"
+	httpClient := http.DefaultClient
+	if tlsEnabled {
+		scheme = "https"
+		// The per-replica server cert is signed by the generated KBS CA (see
+		// generateKbsServerCert); skip verification here rather than plumb that CA through,
+		// the same tradeoff GetKbsEndpoint's waitForKbsTLSListening makes.
+		httpClient = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	}
+
+	resp, err := httpClient.Get(fmt.Sprintf("%s://127.0.0.1:%d/kbs/v0/version", scheme, localPort))
+	if err != nil {
+		return fmt.Errorf("querying /kbs/v0/version on %s: %w", podName, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s /kbs/v0/version", resp.StatusCode, podName)
+	}
+	return nil
+}
+
+func getFreeLocalPort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// KillReplica deletes the idx'th KBS pod (ordered as returned by the API) to exercise failure
+// injection in HA e2e tests; the Deployment recreates it.
+func (p *KeyBrokerService) KillReplica(ctx context.Context, cfg *envconf.Config, idx int) error {
+	if p.HAConfig == nil {
+		return fmt.Errorf("KillReplica requires KeyBrokerService to be configured for HA mode")
+	}
+
+	client, err := cfg.NewClient()
+	if err != nil {
+		return err
+	}
+	namespace := "coco-tenant"
+	resources := client.Resources(namespace)
+
+	pods := &corev1.PodList{}
+	if err := resources.WithLabelSelector(kbsHALabelSelector).List(ctx, pods); err != nil {
+		return err
+	}
+	if idx < 0 || idx >= len(pods.Items) {
+		return fmt.Errorf("replica index %d out of range (have %d replicas)", idx, len(pods.Items))
+	}
+
+	log.Infof("killing KBS replica %s", pods.Items[idx].Name)
+	return resources.Delete(ctx, &pods.Items[idx])
+}
+
+// RestartAll performs a rolling restart of every KBS replica.
+func (p *KeyBrokerService) RestartAll(ctx context.Context, cfg *envconf.Config) error {
+	if p.HAConfig == nil {
+		return fmt.Errorf("RestartAll requires KeyBrokerService to be configured for HA mode")
+	}
+	return restartKbsDeployment(ctx, cfg)
+}
@@ -0,0 +1,380 @@
+// (C) Copyright Confidential Containers Contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package provisioner
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/e2e-framework/pkg/envconf"
+)
+
+const (
+	kbsTLSSecretName = "kbs-tls-certs"
+	kbsTLSMountPath  = "/etc/kbs/tls"
+
+	// kbsConfigMapName/kbsConfigMapKey identify the ConfigMap the base overlay generates from
+	// kbs-config.toml; Trustee KBS reads its HTTPS certificate/key paths from that file's
+	// [http_server] table, not from environment variables.
+	kbsConfigMapName = "kbs-config"
+	kbsConfigMapKey  = "kbs-config.toml"
+)
+
+// KbsTLSConfig enables HTTPS (optionally mTLS) on the KBS endpoint.
+type KbsTLSConfig struct {
+	// ServerCertPEM/ServerKeyPEM let callers bring their own server certificate. When empty,
+	// Deploy generates one signed by the existing KBS auth keypair, acting as the CA.
+	ServerCertPEM []byte
+	ServerKeyPEM  []byte
+
+	// ClientCertPEM/ClientKeyPEM configure mTLS client authentication for kbs-client calls.
+	ClientCertPEM []byte
+	ClientKeyPEM  []byte
+
+	// InsecureSkipVerify disables server certificate verification; dev/test use only.
+	InsecureSkipVerify bool
+
+	// generatedCACertPEM is filled in by deployKbsTLSSecret when ServerCertPEM/ServerKeyPEM are
+	// empty: the CA it self-signs the server certificate with, so kbsClientTLSArgs can hand it to
+	// kbs-client for verification instead of requiring InsecureSkipVerify.
+	generatedCACertPEM []byte
+}
+
+// WithTLSConfig enables HTTPS/mTLS on the KBS endpoint created by NewKeyBrokerService.
+func WithTLSConfig(tlsConfig KbsTLSConfig) KbsServiceOption {
+	return func(o *kbsServiceOptions) {
+		o.tlsConfig = &tlsConfig
+	}
+}
+
+// generateKbsServerCert issues a server certificate for sans, signed by a CA derived from the
+// existing KBS auth keypair (base/kbs.key), mirroring how that keypair is already trusted for
+// KBS resource/attestation policy requests.
+func generateKbsServerCert(sans []string) (serverCertPEM, serverKeyPEM, caCertPEM []byte, err error) {
+	caSigner, err := loadKbsAuthPrivateKey()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kbs-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caSigner.Public(), caSigner)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("creating KBS CA certificate: %w", err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("parsing KBS CA certificate: %w", err)
+	}
+	caCertPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+
+	serverKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("generating KBS server key: %w", err)
+	}
+
+	serverTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "kbs"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     sans,
+	}
+	serverDER, err := x509.CreateCertificate(rand.Reader, serverTemplate, caCert, &serverKey.PublicKey, caSigner)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("creating KBS server certificate: %w", err)
+	}
+	serverCertPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: serverDER})
+
+	serverKeyDER, err := x509.MarshalPKCS8PrivateKey(serverKey)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("marshaling KBS server key: %w", err)
+	}
+	serverKeyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: serverKeyDER})
+
+	return serverCertPEM, serverKeyPEM, caCertPEM, nil
+}
+
+func loadKbsAuthPrivateKey() (crypto.Signer, error) {
+	path := filepath.Join(getKbsKubernetesFilePath(), "base/kbs.key")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading KBS auth private key %s: %w", path, err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in %s", path)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing KBS auth private key %s: %w", path, err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("KBS auth private key %s is not usable as a CA signer", path)
+	}
+	return signer, nil
+}
+
+// deployKbsTLSSecret creates/updates the Secret holding the KBS server certificate and key, and
+// patches the KBS deployment to mount it and serve HTTPS.
+func deployKbsTLSSecret(ctx context.Context, cfg *envconf.Config, tlsConfig *KbsTLSConfig) error {
+	serverCertPEM, serverKeyPEM := tlsConfig.ServerCertPEM, tlsConfig.ServerKeyPEM
+	var caCertPEM []byte
+	if len(serverCertPEM) == 0 || len(serverKeyPEM) == 0 {
+		sans := []string{"kbs", "kbs.coco-tenant", "kbs.coco-tenant.svc", "kbs.coco-tenant.svc.cluster.local"}
+		cert, key, ca, err := generateKbsServerCert(sans)
+		if err != nil {
+			return err
+		}
+		serverCertPEM, serverKeyPEM, caCertPEM = cert, key, ca
+		tlsConfig.generatedCACertPEM = ca
+	}
+
+	client, err := cfg.NewClient()
+	if err != nil {
+		return err
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      kbsTLSSecretName,
+			Namespace: "coco-tenant",
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       serverCertPEM,
+			corev1.TLSPrivateKeyKey: serverKeyPEM,
+			"ca.crt":                caCertPEM,
+		},
+	}
+
+	log.Infof("creating KBS TLS secret %s", kbsTLSSecretName)
+	if err := createOrUpdateSecret(ctx, client, secret); err != nil {
+		return fmt.Errorf("creating secret %s: %w", kbsTLSSecretName, err)
+	}
+
+	if err := patchKbsConfigForTLS(ctx, client); err != nil {
+		return fmt.Errorf("patching kbs config for TLS: %w", err)
+	}
+
+	return patchKbsDeploymentForTLS(ctx, client)
+}
+
+// patchKbsConfigForTLS rewrites the kbs-config.toml ConfigMap to serve HTTPS with the certificate
+// and key mounted at kbsTLSMountPath (by patchKbsDeploymentForTLS), so the KBS process itself
+// actually negotiates TLS rather than continuing to serve plain HTTP.
+func patchKbsConfigForTLS(ctx context.Context, client klientClient) error {
+	namespace := "coco-tenant"
+	resources := client.Resources(namespace)
+
+	cm := &corev1.ConfigMap{}
+	if err := resources.Get(ctx, kbsConfigMapName, namespace, cm); err != nil {
+		return err
+	}
+
+	content, ok := cm.Data[kbsConfigMapKey]
+	if !ok {
+		return fmt.Errorf("configmap %s has no key %s", kbsConfigMapName, kbsConfigMapKey)
+	}
+
+	cm.Data[kbsConfigMapKey] = setHTTPServerTLSPaths(content,
+		filepath.Join(kbsTLSMountPath, "tls.crt"),
+		filepath.Join(kbsTLSMountPath, "tls.key"),
+	)
+
+	return resources.Update(ctx, cm)
+}
+
+// setHTTPServerTLSPaths inserts/replaces the "certificate"/"private_key" keys of the
+// [http_server] table in a kbs-config.toml document. It assumes the base overlay's
+// kbs-config.toml already has a [http_server] table (it always does, for the "sockets" key).
+func setHTTPServerTLSPaths(content, certPath, keyPath string) string {
+	lines := strings.Split(content, "\n")
+	var out []string
+	inHTTPServer := false
+	inserted := false
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") {
+			if inHTTPServer && !inserted {
+				out = append(out, fmt.Sprintf("certificate = %q", certPath))
+				out = append(out, fmt.Sprintf("private_key = %q", keyPath))
+				inserted = true
+			}
+			inHTTPServer = trimmed == "[http_server]"
+			out = append(out, line)
+			continue
+		}
+		if inHTTPServer && (strings.HasPrefix(trimmed, "certificate ") || strings.HasPrefix(trimmed, "private_key ")) {
+			continue
+		}
+		out = append(out, line)
+	}
+	if inHTTPServer && !inserted {
+		out = append(out, fmt.Sprintf("certificate = %q", certPath))
+		out = append(out, fmt.Sprintf("private_key = %q", keyPath))
+	}
+	return strings.Join(out, "\n")
+}
+
+func patchKbsDeploymentForTLS(ctx context.Context, client klientClient) error {
+	namespace := "coco-tenant"
+	deploymentName := "kbs"
+	resources := client.Resources(namespace)
+
+	deployment := &appsv1.Deployment{}
+	if err := resources.Get(ctx, deploymentName, namespace, deployment); err != nil {
+		return err
+	}
+
+	deployment.Spec.Template.Spec.Volumes = append(deployment.Spec.Template.Spec.Volumes, corev1.Volume{
+		Name: "kbs-tls-certs",
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{SecretName: kbsTLSSecretName},
+		},
+	})
+
+	for i := range deployment.Spec.Template.Spec.Containers {
+		c := &deployment.Spec.Template.Spec.Containers[i]
+		if c.Name != "kbs" {
+			continue
+		}
+		c.VolumeMounts = append(c.VolumeMounts, corev1.VolumeMount{
+			Name:      "kbs-tls-certs",
+			MountPath: kbsTLSMountPath,
+			ReadOnly:  true,
+		})
+	}
+
+	return resources.Update(ctx, deployment)
+}
+
+func deleteKbsTLSSecret(ctx context.Context, cfg *envconf.Config) error {
+	client, err := cfg.NewClient()
+	if err != nil {
+		return err
+	}
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: kbsTLSSecretName, Namespace: "coco-tenant"}}
+	if err := client.Resources().Delete(ctx, secret); err != nil {
+		log.Warnf("failed to delete secret %s: %v", kbsTLSSecretName, err)
+	}
+	return nil
+}
+
+// kbsClientTLSArgs returns the extra kbs-client CLI flags needed to talk to a TLS-enabled KBS.
+// kbs-client runs on the local test host (not in the KBS pod), so any mTLS client cert/key is
+// materialized to local temp files rather than referenced by its in-pod mount path.
+func (p *KeyBrokerService) kbsClientTLSArgs() ([]string, error) {
+	if p.TLSConfig == nil {
+		return nil, nil
+	}
+
+	var args []string
+	if p.TLSConfig.InsecureSkipVerify {
+		args = append(args, "--insecure")
+	} else if len(p.TLSConfig.generatedCACertPEM) > 0 {
+		// The server cert was self-signed by deployKbsTLSSecret against a generated CA that
+		// kbs-client has no other way to learn about; hand it the CA explicitly so verification
+		// can succeed without falling back to --insecure.
+		caPath, err := writeKbsClientCACertFile(p.TLSConfig.generatedCACertPEM)
+		if err != nil {
+			return nil, fmt.Errorf("writing kbs-client CA cert to disk: %w", err)
+		}
+		args = append(args, "--cert-file", caPath)
+	}
+	if len(p.TLSConfig.ClientCertPEM) > 0 && len(p.TLSConfig.ClientKeyPEM) > 0 {
+		certPath, keyPath, err := writeKbsClientCertFiles(p.TLSConfig.ClientCertPEM, p.TLSConfig.ClientKeyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("writing kbs-client TLS cert/key to disk: %w", err)
+		}
+		args = append(args, "--cert", certPath, "--key", keyPath)
+	}
+	return args, nil
+}
+
+// writeKbsClientCACertFile materializes a CA certificate to a local temp file for kbs-client,
+// which reads it off the filesystem it runs on.
+func writeKbsClientCACertFile(caCertPEM []byte) (string, error) {
+	dir, err := os.MkdirTemp("", "kbs-client-tls-")
+	if err != nil {
+		return "", err
+	}
+
+	caPath := filepath.Join(dir, "ca.crt")
+	if err := os.WriteFile(caPath, caCertPEM, 0600); err != nil {
+		return "", fmt.Errorf("writing %s: %w", caPath, err)
+	}
+	return caPath, nil
+}
+
+// writeKbsClientCertFiles materializes an mTLS client certificate/key pair to local temp files
+// for kbs-client, which reads them off the filesystem it runs on.
+func writeKbsClientCertFiles(certPEM, keyPEM []byte) (certPath, keyPath string, err error) {
+	dir, err := os.MkdirTemp("", "kbs-client-tls-")
+	if err != nil {
+		return "", "", err
+	}
+
+	certPath = filepath.Join(dir, "client.crt")
+	if err := os.WriteFile(certPath, certPEM, 0600); err != nil {
+		return "", "", fmt.Errorf("writing %s: %w", certPath, err)
+	}
+
+	keyPath = filepath.Join(dir, "client.key")
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return "", "", fmt.Errorf("writing %s: %w", keyPath, err)
+	}
+
+	return certPath, keyPath, nil
+}
+
+// waitForKbsTLSListening confirms the KBS server actually negotiates TLS on addr, retrying until
+// timeout: patchKbsConfigForTLS's ConfigMap edit only takes effect once the KBS process has
+// reloaded, which lags behind the deployment reporting Available.
+func waitForKbsTLSListening(nodeIP string, nodePort int32, timeout time.Duration) error {
+	addr := fmt.Sprintf("%s:%d", nodeIP, nodePort)
+	deadline := time.Now().Add(timeout)
+	var lastErr error
+	for time.Now().Before(deadline) {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, &tls.Config{InsecureSkipVerify: true})
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		lastErr = err
+		time.Sleep(5 * time.Second)
+	}
+	return fmt.Errorf("timed out waiting for %s to negotiate TLS: %w", addr, lastErr)
+}
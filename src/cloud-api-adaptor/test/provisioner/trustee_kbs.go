@@ -5,11 +5,8 @@ package provisioner
 
 import (
 	"context"
-	"crypto/ed25519"
-	"crypto/rand"
-	"crypto/x509"
-	"encoding/pem"
 	"fmt"
+	"math/rand"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -20,6 +17,7 @@ import (
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/e2e-framework/klient/k8s"
 	"sigs.k8s.io/e2e-framework/klient/wait"
 	"sigs.k8s.io/e2e-framework/klient/wait/conditions"
 	"sigs.k8s.io/e2e-framework/pkg/envconf"
@@ -49,7 +47,29 @@ func getKbsKubernetesFilePath() string {
 	return filepath.Join(trusteeRepoPath, "/kbs/config/kubernetes/")
 }
 
-func NewKeyBrokerService(clusterName string, cfg *envconf.Config) (*KeyBrokerService, error) {
+// KbsServiceOption customizes NewKeyBrokerService.
+type KbsServiceOption func(*kbsServiceOptions)
+
+type kbsServiceOptions struct {
+	authKeyConfig KbsAuthKeyConfig
+	tlsConfig     *KbsTLSConfig
+	haConfig      *KbsHAConfig
+}
+
+// WithAuthKeyConfig selects the algorithm (and, optionally, an externally managed private key)
+// used for the KBS auth keypair. Defaults to Ed25519 when not given.
+func WithAuthKeyConfig(authKeyConfig KbsAuthKeyConfig) KbsServiceOption {
+	return func(o *kbsServiceOptions) {
+		o.authKeyConfig = authKeyConfig
+	}
+}
+
+func NewKeyBrokerService(clusterName string, cfg *envconf.Config, opts ...KbsServiceOption) (*KeyBrokerService, error) {
+	options := kbsServiceOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
 	e2e_dir, err := os.Getwd()
 	if err != nil {
 		err = fmt.Errorf("getting the current working directory: %w\n", err)
@@ -88,33 +108,14 @@ func NewKeyBrokerService(clusterName string, cfg *envconf.Config) (*KeyBrokerSer
 	kbsCert := filepath.Join(getKbsKubernetesFilePath(), "base/kbs.pem")
 	if _, err := os.Stat(kbsCert); os.IsNotExist(err) {
 		kbsKey := filepath.Join(getKbsKubernetesFilePath(), "base/kbs.key")
-		keyOutputFile, err := os.Create(kbsKey)
-		if err != nil {
-			err = fmt.Errorf("creating key file: %w\n", err)
-			log.Errorf("%v", err)
-			return nil, err
-		}
-		defer keyOutputFile.Close()
 
-		pubKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		privateKeyPEM, publicKeyPEM, algorithm, err := prepareKbsAuthKeyPair(options.authKeyConfig)
 		if err != nil {
-			err = fmt.Errorf("generating Ed25519 key pair: %w\n", err)
+			err = fmt.Errorf("preparing KBS auth key pair: %w\n", err)
 			log.Errorf("%v", err)
 			return nil, err
 		}
 
-		b, err := x509.MarshalPKCS8PrivateKey(privateKey)
-		if err != nil {
-			err = fmt.Errorf("MarshalPKCS8PrivateKey private key: %w\n", err)
-			log.Errorf("%v", err)
-			return nil, err
-		}
-
-		privateKeyPEM := pem.EncodeToMemory(&pem.Block{
-			Type:  "PRIVATE KEY",
-			Bytes: b,
-		})
-
 		// Save private key to file
 		err = saveToFile(kbsKey, privateKeyPEM)
 		if err != nil {
@@ -123,18 +124,6 @@ func NewKeyBrokerService(clusterName string, cfg *envconf.Config) (*KeyBrokerSer
 			return nil, err
 		}
 
-		b, err = x509.MarshalPKIXPublicKey(pubKey)
-		if err != nil {
-			err = fmt.Errorf("MarshalPKIXPublicKey Ed25519 public key: %w\n", err)
-			log.Errorf("%v", err)
-			return nil, err
-		}
-
-		publicKeyPEM := pem.EncodeToMemory(&pem.Block{
-			Type:  "PUBLIC KEY",
-			Bytes: b,
-		})
-
 		// Save public key to file
 		err = saveToFile(kbsCert, publicKeyPEM)
 		if err != nil {
@@ -143,6 +132,11 @@ func NewKeyBrokerService(clusterName string, cfg *envconf.Config) (*KeyBrokerSer
 			return nil, err
 		}
 
+		if err := writeKbsAuthKeyMetadata(kbsAuthKeyMetadataPath(), algorithm, publicKeyPEM); err != nil {
+			err = fmt.Errorf("writing KBS auth key metadata: %w\n", err)
+			log.Errorf("%v", err)
+			return nil, err
+		}
 	}
 
 	customPCCSURL := os.Getenv("CUSTOM_PCCS_URL")
@@ -158,15 +152,24 @@ func NewKeyBrokerService(clusterName string, cfg *envconf.Config) (*KeyBrokerSer
 	}
 
 	// IBM_SE_CREDS_DIR describe at https://github.com/confidential-containers/trustee/blob/main/kbs/config/kubernetes/README.md#deploy-kbs
+	var ibmSEDistribution *ibmSEDistributionResources
 	ibmseCredsDir := os.Getenv("IBM_SE_CREDS_DIR")
 	if ibmseCredsDir != "" {
 		log.Info("IBM_SE_CREDS_DIR is providered, deploy KBS with IBM SE verifier")
 		// We always deploy the KBS pod to first worker node
 		workerNodeIP, workerNodeName, _ := getFirstWorkerNodeIPAndName(cfg)
-		log.Infof("Copying IBM_SE_CREDS files to first worker node: %s", workerNodeIP)
-		err := copyGivenFilesToWorkerNode(ibmseCredsDir, workerNodeIP)
-		if err != nil {
-			return nil, err
+		switch getIBMSEDistributionMode() {
+		case ibmSeDistributionJob:
+			log.Infof("Distributing IBM_SE_CREDS files to %s via an in-cluster Job", workerNodeName)
+			ibmSEDistribution, err = distributeIBMSECredsViaJob(context.Background(), cfg, ibmseCredsDir, workerNodeName)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			log.Infof("Copying IBM_SE_CREDS files to first worker node: %s", workerNodeIP)
+			if err := copyGivenFilesToWorkerNode(ibmseCredsDir, workerNodeIP); err != nil {
+				return nil, err
+			}
 		}
 		log.Infof("Creating PV for kbs with ibm-se")
 
@@ -192,9 +195,23 @@ func NewKeyBrokerService(clusterName string, cfg *envconf.Config) (*KeyBrokerSer
 		return nil, err
 	}
 
+	// KBS_IMAGE_TARBALL/KBS_REGISTRY_MIRROR select the airgap overlay used by Deploy/Delete so
+	// tests can run without pulling from ghcr.io/quay.io.
+	airgapImageTarball := os.Getenv("KBS_IMAGE_TARBALL")
+	airgapRegistryMirror := os.Getenv("KBS_REGISTRY_MIRROR")
+	if airgapImageTarball != "" || airgapRegistryMirror != "" {
+		log.Infof("Airgap KBS deployment requested (tarball=%q, registryMirror=%q)", airgapImageTarball, airgapRegistryMirror)
+	}
+
 	return &KeyBrokerService{
-		installOverlay: overlay,
-		endpoint:       "",
+		installOverlay:       overlay,
+		endpoint:             "",
+		ibmSEDistribution:    ibmSEDistribution,
+		airgapImageTarball:   airgapImageTarball,
+		airgapRegistryMirror: airgapRegistryMirror,
+		authKeyConfig:        options.authKeyConfig,
+		TLSConfig:            options.tlsConfig,
+		HAConfig:             options.haConfig,
 	}, nil
 }
 
@@ -335,19 +352,26 @@ func NewBaseKbsInstallOverlay(installDir string) (InstallOverlay, error) {
 	}, nil
 }
 
-func NewKbsInstallOverlay(installDir string) (InstallOverlay, error) {
-	log.Info("Creating kbs install overlay")
+// getKbsOverlayFolder picks the kustomize overlay folder used to deploy KBS, relative to the
+// trustee repo root.
+func getKbsOverlayFolder() (string, error) {
 	platform, err := getHardwarePlatform()
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	var overlayFolder string
 	if platform == "x86_64" && os.Getenv("CUSTOM_PCCS_URL") != "" {
 		log.Info("CUSTOM_PCCS_URL is provided on x86_64, deploy with custom pccs config")
-		overlayFolder = "kbs/config/kubernetes/custom_pccs"
-	} else {
-		overlayFolder = "kbs/config/kubernetes/nodeport/"
+		return "kbs/config/kubernetes/custom_pccs", nil
+	}
+	return "kbs/config/kubernetes/nodeport/", nil
+}
+
+func NewKbsInstallOverlay(installDir string) (InstallOverlay, error) {
+	log.Info("Creating kbs install overlay")
+	overlayFolder, err := getKbsOverlayFolder()
+	if err != nil {
+		return nil, err
 	}
 
 	overlay, err := NewKustomizeOverlay(filepath.Join(installDir, overlayFolder))
@@ -360,6 +384,28 @@ func NewKbsInstallOverlay(installDir string) (InstallOverlay, error) {
 	}, nil
 }
 
+// newKbsDeployOverlay picks the install overlay used by Deploy/Delete: the plain nodeport/custom
+// pccs overlay, or the airgap overlay when an image tarball or registry mirror was configured.
+// When haConfig is set, the resulting overlay is additionally wrapped so Apply scales KBS to
+// multiple replicas behind a stable VIP.
+func newKbsDeployOverlay(installDir, registryMirror, imageTarball string, haConfig *KbsHAConfig) (InstallOverlay, error) {
+	var overlay InstallOverlay
+	var err error
+	if registryMirror == "" && imageTarball == "" {
+		overlay, err = NewKbsInstallOverlay(installDir)
+	} else {
+		overlay, err = NewAirgapKbsInstallOverlay(installDir, registryMirror, imageTarball)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if haConfig != nil {
+		return &HAKbsInstallOverlay{overlay: overlay, haConfig: *haConfig}, nil
+	}
+	return overlay, nil
+}
+
 func (lio *KbsInstallOverlay) Apply(ctx context.Context, cfg *envconf.Config) error {
 	return lio.overlay.Apply(ctx, cfg)
 }
@@ -425,13 +471,21 @@ func (p *KeyBrokerService) GetKbsEndpoint(ctx context.Context, cfg *envconf.Conf
 
 	resources := client.Resources(namespace)
 
-	kbsDeployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: deploymentName, Namespace: namespace}}
-	fmt.Printf("Wait for the %s deployment be available\n", deploymentName)
-	if err = wait.For(conditions.New(resources).DeploymentConditionMatch(kbsDeployment, appsv1.DeploymentAvailable, corev1.ConditionTrue),
-		wait.WithTimeout(time.Minute*2)); err != nil {
+	log.Infof("Waiting for the %s deployment to become available", deploymentName)
+	if err := waitForDeploymentAvailableWithBackoff(ctx, resources, deploymentName, namespace); err != nil {
 		return "", err
 	}
 
+	if p.HAConfig != nil {
+		log.Infof("Waiting for %d KBS HA replicas to become ready", kbsHAReplicas(*p.HAConfig))
+		endpoint, err := waitForHAReplicasReady(ctx, cfg, namespace, *p.HAConfig, p.TLSConfig != nil)
+		if err != nil {
+			return "", err
+		}
+		p.endpoint = endpoint
+		return p.endpoint, nil
+	}
+
 	services := &corev1.ServiceList{}
 	if err := resources.List(context.TODO(), services); err != nil {
 		return "", err
@@ -457,7 +511,14 @@ func (p *KeyBrokerService) GetKbsEndpoint(ctx context.Context, cfg *envconf.Conf
 				return "", err
 			}
 
-			p.endpoint = fmt.Sprintf("http://%s:%d", nodeIP, nodePort)
+			scheme := "http"
+			if p.TLSConfig != nil {
+				scheme = "https"
+				if err := waitForKbsTLSListening(nodeIP, nodePort, getKbsEndpointTimeout()); err != nil {
+					return "", fmt.Errorf("KBS not serving TLS: %w", err)
+				}
+			}
+			p.endpoint = fmt.Sprintf("%s://%s:%d", scheme, nodeIP, nodePort)
 			return p.endpoint, nil
 		}
 	}
@@ -465,12 +526,74 @@ func (p *KeyBrokerService) GetKbsEndpoint(ctx context.Context, cfg *envconf.Conf
 	return "", fmt.Errorf("Service %s not found", serviceName)
 }
 
+// kbsEndpointBackoffBase/Cap bound the jittered exponential backoff used by
+// waitForDeploymentAvailableWithBackoff, mirroring the pattern k3s uses when agents poll the
+// server for their config: start fast, back off quickly, avoid a thundering herd against the API
+// server on slow-provisioning clusters (e.g. peer-pod VMs still booting).
+const (
+	kbsEndpointBackoffBase = 2 * time.Second
+	kbsEndpointBackoffCap  = 30 * time.Second
+	kbsEndpointTimeoutEnv  = "KBS_ENDPOINT_TIMEOUT"
+	kbsEndpointTimeoutDflt = 10 * time.Minute
+)
+
+func getKbsEndpointTimeout() time.Duration {
+	if v := os.Getenv(kbsEndpointTimeoutEnv); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+		log.Warnf("ignoring invalid %s=%q, using default %s", kbsEndpointTimeoutEnv, v, kbsEndpointTimeoutDflt)
+	}
+	return kbsEndpointTimeoutDflt
+}
+
+func waitForDeploymentAvailableWithBackoff(ctx context.Context, resources k8s.Resources, deploymentName, namespace string) error {
+	budget := getKbsEndpointTimeout()
+	deadline := time.Now().Add(budget)
+
+	for attempt := 0; ; attempt++ {
+		deployment := &appsv1.Deployment{}
+		if err := resources.Get(ctx, deploymentName, namespace, deployment); err != nil {
+			return err
+		}
+
+		condition := "Unknown"
+		for _, c := range deployment.Status.Conditions {
+			if c.Type == appsv1.DeploymentAvailable {
+				condition = string(c.Status)
+				if c.Status == corev1.ConditionTrue {
+					return nil
+				}
+				break
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %s waiting for %s deployment to become available (last condition: %s)", budget, deploymentName, condition)
+		}
+
+		backoff := kbsEndpointBackoffBase << attempt
+		if backoff <= 0 || backoff > kbsEndpointBackoffCap {
+			backoff = kbsEndpointBackoffCap
+		}
+		jittered := time.Duration(rand.Int63n(int64(backoff)))
+		log.Infof("%s deployment condition is %s, retrying in %s", deploymentName, condition, jittered)
+		time.Sleep(jittered)
+	}
+}
+
 func (p *KeyBrokerService) EnableKbsCustomizedResourcePolicy(customizedOpaFile string) error {
 	kbsClientDir := filepath.Join(trusteeRepoPath, "target/release")
 	privateKey := filepath.Join(getKbsKubernetesFilePath(), "base/kbs.key")
 	policyFile := filepath.Join(trusteeRepoPath, "kbs/sample_policies", customizedOpaFile)
 	log.Info("EnableKbsCustomizedPolicy: ", policyFile)
-	cmd := exec.Command("./kbs-client", "--url", p.endpoint, "config", "--auth-private-key", privateKey, "set-resource-policy", "--policy-file", policyFile)
+	tlsArgs, err := p.kbsClientTLSArgs()
+	if err != nil {
+		return err
+	}
+	args := append([]string{"--url", p.endpoint}, tlsArgs...)
+	args = append(args, "config", "--auth-private-key", privateKey, "set-resource-policy", "--policy-file", policyFile)
+	cmd := exec.Command("./kbs-client", args...)
 	cmd.Dir = kbsClientDir
 	cmd.Env = os.Environ()
 	stdoutStderr, err := cmd.CombinedOutput()
@@ -478,6 +601,7 @@ func (p *KeyBrokerService) EnableKbsCustomizedResourcePolicy(customizedOpaFile s
 	if err != nil {
 		return err
 	}
+	p.lastResourcePolicyFile = customizedOpaFile
 	return nil
 }
 
@@ -486,7 +610,13 @@ func (p *KeyBrokerService) EnableKbsCustomizedAttestationPolicy(customizedOpaFil
 	privateKey := filepath.Join(getKbsKubernetesFilePath(), "base/kbs.key")
 	policyFile := filepath.Join(trusteeRepoPath, "kbs/sample_policies", customizedOpaFile)
 	log.Info("EnableKbsCustomizedPolicy: ", policyFile)
-	cmd := exec.Command("./kbs-client", "--url", p.endpoint, "config", "--auth-private-key", privateKey, "set-attestation-policy", "--policy-file", policyFile)
+	tlsArgs, err := p.kbsClientTLSArgs()
+	if err != nil {
+		return err
+	}
+	args := append([]string{"--url", p.endpoint}, tlsArgs...)
+	args = append(args, "config", "--auth-private-key", privateKey, "set-attestation-policy", "--policy-file", policyFile)
+	cmd := exec.Command("./kbs-client", args...)
 	cmd.Dir = kbsClientDir
 	cmd.Env = os.Environ()
 	stdoutStderr, err := cmd.CombinedOutput()
@@ -494,6 +624,7 @@ func (p *KeyBrokerService) EnableKbsCustomizedAttestationPolicy(customizedOpaFil
 	if err != nil {
 		return err
 	}
+	p.lastAttestationPolicyFile = customizedOpaFile
 	return nil
 }
 
@@ -506,7 +637,13 @@ func (p *KeyBrokerService) SetSampleSecretKey() error {
 	}
 	keyFilePath := filepath.Join(getKbsKubernetesFilePath(), overlaysPath, "key.bin")
 	log.Info("set key resource: ", keyFilePath)
-	cmd := exec.Command("./kbs-client", "--url", p.endpoint, "config", "--auth-private-key", privateKey, "set-resource", "--path", "reponame/workload_key/key.bin", "--resource-file", keyFilePath)
+	tlsArgs, err := p.kbsClientTLSArgs()
+	if err != nil {
+		return err
+	}
+	args := append([]string{"--url", p.endpoint}, tlsArgs...)
+	args = append(args, "config", "--auth-private-key", privateKey, "set-resource", "--path", "reponame/workload_key/key.bin", "--resource-file", keyFilePath)
+	cmd := exec.Command("./kbs-client", args...)
 	cmd.Dir = kbsClientDir
 	cmd.Env = os.Environ()
 	stdoutStderr, err := cmd.CombinedOutput()
@@ -514,9 +651,109 @@ func (p *KeyBrokerService) SetSampleSecretKey() error {
 	if err != nil {
 		return err
 	}
+	p.sampleSecretKeySet = true
+	return nil
+}
+
+// RotateAuthKey generates (or imports) a new KBS auth keypair per authKeyCfg, replaces
+// base/kbs.key and base/kbs.pem, restarts the KBS deployment so it picks up the new key, and
+// re-issues any resource/attestation policy and sample secret previously set via
+// EnableKbsCustomizedResourcePolicy/EnableKbsCustomizedAttestationPolicy/SetSampleSecretKey so
+// they keep working against the rotated key.
+func (p *KeyBrokerService) RotateAuthKey(ctx context.Context, cfg *envconf.Config, authKeyCfg KbsAuthKeyConfig) error {
+	privateKeyPEM, publicKeyPEM, algorithm, err := prepareKbsAuthKeyPair(authKeyCfg)
+	if err != nil {
+		return fmt.Errorf("preparing KBS auth key pair: %w", err)
+	}
+
+	kbsKey := filepath.Join(getKbsKubernetesFilePath(), "base/kbs.key")
+	kbsCert := filepath.Join(getKbsKubernetesFilePath(), "base/kbs.pem")
+
+	if err := saveToFile(kbsKey, privateKeyPEM); err != nil {
+		return fmt.Errorf("saving private key to file: %w", err)
+	}
+	if err := saveToFile(kbsCert, publicKeyPEM); err != nil {
+		return fmt.Errorf("saving public key to file: %w", err)
+	}
+	if err := writeKbsAuthKeyMetadata(kbsAuthKeyMetadataPath(), algorithm, publicKeyPEM); err != nil {
+		return fmt.Errorf("writing KBS auth key metadata: %w", err)
+	}
+	p.authKeyConfig = authKeyCfg
+
+	// The rotated public key only takes effect once the KBS overlay that derives the pubkey
+	// Secret/ConfigMap from base/kbs.pem has been re-applied; a deployment restart alone just
+	// re-creates pods against the existing (stale) Secret.
+	log.Info("Re-applying KBS overlay to pick up the rotated auth key")
+	tmpoverlay, err := newKbsDeployOverlay(trusteeRepoPath, p.airgapRegistryMirror, p.airgapImageTarball, p.HAConfig)
+	if err != nil {
+		return fmt.Errorf("creating kbs overlay: %w", err)
+	}
+	if err := tmpoverlay.Apply(ctx, cfg); err != nil {
+		return fmt.Errorf("re-applying kbs overlay: %w", err)
+	}
+
+	// The overlay re-apply above reverts the runtime TLS patches Deploy applied on top of it
+	// (patchKbsConfigForTLS/patchKbsDeploymentForTLS), so a TLS-configured KBS would otherwise
+	// silently drop back to plain HTTP after rotation.
+	if p.TLSConfig != nil {
+		log.Info("Re-deploying KBS server certificate for HTTPS after overlay re-apply")
+		if err := deployKbsTLSSecret(ctx, cfg, p.TLSConfig); err != nil {
+			return fmt.Errorf("re-deploying kbs TLS secret: %w", err)
+		}
+	}
+
+	log.Info("Restarting KBS deployment to pick up the rotated auth key")
+	if err := restartKbsDeployment(ctx, cfg); err != nil {
+		return fmt.Errorf("restarting kbs deployment: %w", err)
+	}
+
+	if p.lastResourcePolicyFile != "" {
+		if err := p.EnableKbsCustomizedResourcePolicy(p.lastResourcePolicyFile); err != nil {
+			return fmt.Errorf("re-issuing resource policy after key rotation: %w", err)
+		}
+	}
+	if p.lastAttestationPolicyFile != "" {
+		if err := p.EnableKbsCustomizedAttestationPolicy(p.lastAttestationPolicyFile); err != nil {
+			return fmt.Errorf("re-issuing attestation policy after key rotation: %w", err)
+		}
+	}
+	if p.sampleSecretKeySet {
+		if err := p.SetSampleSecretKey(); err != nil {
+			return fmt.Errorf("re-issuing sample secret key after key rotation: %w", err)
+		}
+	}
+
 	return nil
 }
 
+func restartKbsDeployment(ctx context.Context, cfg *envconf.Config) error {
+	client, err := cfg.NewClient()
+	if err != nil {
+		return err
+	}
+
+	namespace := "coco-tenant"
+	deploymentName := "kbs"
+	resources := client.Resources(namespace)
+
+	deployment := &appsv1.Deployment{}
+	if err := resources.Get(ctx, deploymentName, namespace, deployment); err != nil {
+		return err
+	}
+
+	if deployment.Spec.Template.ObjectMeta.Annotations == nil {
+		deployment.Spec.Template.ObjectMeta.Annotations = map[string]string{}
+	}
+	deployment.Spec.Template.ObjectMeta.Annotations["kubectl.kubernetes.io/restartedAt"] = time.Now().UTC().Format(time.RFC3339)
+
+	if err := resources.Update(ctx, deployment); err != nil {
+		return err
+	}
+
+	return wait.For(conditions.New(resources).DeploymentConditionMatch(deployment, appsv1.DeploymentAvailable, corev1.ConditionTrue),
+		wait.WithTimeout(time.Minute*2))
+}
+
 func (p *KeyBrokerService) Deploy(ctx context.Context, cfg *envconf.Config, props map[string]string) error {
 	log.Info("Customize the overlay yaml file")
 	if err := p.installOverlay.Edit(ctx, cfg, props); err != nil {
@@ -524,7 +761,7 @@ func (p *KeyBrokerService) Deploy(ctx context.Context, cfg *envconf.Config, prop
 	}
 
 	// Create kustomize pointer for overlay directory with updated changes
-	tmpoverlay, err := NewKbsInstallOverlay(trusteeRepoPath)
+	tmpoverlay, err := newKbsDeployOverlay(trusteeRepoPath, p.airgapRegistryMirror, p.airgapImageTarball, p.HAConfig)
 	if err != nil {
 		return err
 	}
@@ -533,12 +770,19 @@ func (p *KeyBrokerService) Deploy(ctx context.Context, cfg *envconf.Config, prop
 	if err := tmpoverlay.Apply(ctx, cfg); err != nil {
 		return err
 	}
+
+	if p.TLSConfig != nil {
+		log.Info("Deploying KBS server certificate for HTTPS")
+		if err := deployKbsTLSSecret(ctx, cfg, p.TLSConfig); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func (p *KeyBrokerService) Delete(ctx context.Context, cfg *envconf.Config) error {
 	// Create kustomize pointer for overlay directory with updated changes
-	tmpoverlay, err := NewKbsInstallOverlay(trusteeRepoPath)
+	tmpoverlay, err := newKbsDeployOverlay(trusteeRepoPath, p.airgapRegistryMirror, p.airgapImageTarball, p.HAConfig)
 	if err != nil {
 		return err
 	}
@@ -547,5 +791,18 @@ func (p *KeyBrokerService) Delete(ctx context.Context, cfg *envconf.Config) erro
 	if err = tmpoverlay.Delete(ctx, cfg); err != nil {
 		return err
 	}
+
+	if p.ibmSEDistribution != nil {
+		log.Info("Cleaning up IBM SE creds distribution Job and Secrets")
+		if err := deleteIBMSEDistributionResources(ctx, cfg, p.ibmSEDistribution); err != nil {
+			return err
+		}
+	}
+
+	if p.TLSConfig != nil {
+		if err := deleteKbsTLSSecret(ctx, cfg); err != nil {
+			return err
+		}
+	}
 	return nil
 }